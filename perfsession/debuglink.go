@@ -0,0 +1,179 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// debugDirsKey is the Extra key for the list of directories to search
+// for separate debug-info files, as set by SetDebugDirs.
+var debugDirsKey = NewExtraKey("perfsession.debugDirs")
+
+// DefaultDebugDirs lists the directories searched for a companion
+// debug-info file when a binary's own DWARF has been stripped. These
+// match the defaults used by delve and parca.
+var DefaultDebugDirs = []string{"/usr/lib/debug"}
+
+// SetDebugDirs overrides the list of directories session searches for
+// separate debug-info files, in place of DefaultDebugDirs. This lets
+// callers point at a local debuginfod-style cache.
+func SetDebugDirs(session *Session, dirs []string) {
+	session.Extra[debugDirsKey] = dirs
+}
+
+func debugDirs(session *Session) []string {
+	if dirs, ok := session.Extra[debugDirsKey].([]string); ok {
+		return dirs
+	}
+	return DefaultDebugDirs
+}
+
+// debugInfoFinder is implemented by object file backends that support
+// locating a separate file holding DWARF debug info, e.g. via the GNU
+// debuglink/build-id conventions. Only ELF supports this today.
+type debugInfoFinder interface {
+	findDebugInfo(dirs []string, filename string) (*dwarf.Data, bool, error)
+}
+
+func (o *elfObjFile) findDebugInfo(dirs []string, filename string) (*dwarf.Data, bool, error) {
+	isReloc := o.f.Type == elf.ET_DYN
+
+	for _, candidate := range debugFileCandidates(dirs, filename, o.f) {
+		df, err := elf.Open(candidate)
+		if err != nil {
+			continue
+		}
+		data, err := df.DWARF()
+		df.Close()
+		if err != nil {
+			continue
+		}
+		return data, isReloc, nil
+	}
+
+	return nil, false, nil
+}
+
+// debugFileCandidates returns, in search order, the paths worth
+// trying for a separate debug-info file for the ELF file elff loaded
+// from filename. See dso__load in tools/perf/util/symbol-elf.c for
+// the equivalent logic in perf itself.
+func debugFileCandidates(dirs []string, filename string, elff *elf.File) []string {
+	var out []string
+
+	if id, ok := readBuildID(elff); ok {
+		for _, dir := range dirs {
+			out = append(out, fmt.Sprintf("%s/.build-id/%s/%s.debug", dir, id[:2], id[2:]))
+		}
+	}
+
+	if name, crc, ok := readDebuglink(elff); ok {
+		binDir := filepath.Dir(filename)
+		candidates := []string{filepath.Join(binDir, name)}
+		for _, dir := range dirs {
+			candidates = append(candidates, filepath.Join(dir, binDir, name))
+		}
+		for _, c := range candidates {
+			if debuglinkCRCMatches(c, crc) {
+				out = append(out, c)
+			}
+		}
+	}
+
+	return out
+}
+
+// readDebuglink reads the .gnu_debuglink section, which holds the
+// file name of a companion debug-info file followed by its CRC32 (in
+// the ELF file's byte order), zero-padded to a multiple of 4 bytes.
+func readDebuglink(elff *elf.File) (name string, crc uint32, ok bool) {
+	sec := elff.Section(".gnu_debuglink")
+	if sec == nil {
+		return "", 0, false
+	}
+	data, err := sec.Data()
+	if err != nil || len(data) < 5 {
+		return "", 0, false
+	}
+
+	i := 0
+	for i < len(data) && data[i] != 0 {
+		i++
+	}
+	if i+4 > len(data) {
+		return "", 0, false
+	}
+	name = string(data[:i])
+	crc = elff.ByteOrder.Uint32(data[len(data)-4:])
+	return name, crc, true
+}
+
+// readBuildID reads the .note.gnu.build-id note and returns it as a
+// lowercase hex string, as used in the /usr/lib/debug/.build-id/xx/…
+// debuginfod-style cache layout.
+func readBuildID(elff *elf.File) (id string, ok bool) {
+	sec := elff.Section(".note.gnu.build-id")
+	if sec == nil {
+		return "", false
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return "", false
+	}
+
+	r := bytes.NewReader(data)
+	for {
+		var namesz, descsz, typ uint32
+		if err := binary.Read(r, elff.ByteOrder, &namesz); err != nil {
+			return "", false
+		}
+		if err := binary.Read(r, elff.ByteOrder, &descsz); err != nil {
+			return "", false
+		}
+		if err := binary.Read(r, elff.ByteOrder, &typ); err != nil {
+			return "", false
+		}
+		name := make([]byte, align4(namesz))
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", false
+		}
+		desc := make([]byte, align4(descsz))
+		if _, err := io.ReadFull(r, desc); err != nil {
+			return "", false
+		}
+
+		const noteTypeGNUBuildID = 3
+		if typ == noteTypeGNUBuildID && string(name[:min(len(name), 4)]) == "GNU\x00" {
+			return fmt.Sprintf("%x", desc[:descsz]), true
+		}
+	}
+}
+
+func align4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
+
+func debuglinkCRCMatches(filename string, want uint32) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+	return h.Sum32() == want
+}
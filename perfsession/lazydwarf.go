@@ -0,0 +1,257 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"container/list"
+	"debug/dwarf"
+	"sort"
+	"sync"
+)
+
+// cuIndexCapacity bounds how many compile units' parsed subprograms
+// and line tables a symbolicExtra keeps resident at once. Profiling a
+// binary with gigabytes of DWARF (e.g. a Chrome-sized executable)
+// would otherwise mean holding every CU's functab and line table in
+// memory simultaneously; this caps it to the working set actually
+// being symbolized.
+const cuIndexCapacity = 32
+
+// cuRange is a lightweight index entry mapping a PC range to the
+// compile unit that covers it. Building this requires only a shallow
+// walk of top-level DW_TAG_compile_unit entries, not the full DIE
+// tree, so it stays cheap to keep resident even for huge binaries.
+//
+// TODO: Index from .debug_aranges instead, if present; the dwarf
+// package parses that section but doesn't expose it (see aranges in
+// debug/dwarf/open.go), so this falls back to each CU's own
+// DW_AT_low_pc/high_pc or DW_AT_ranges, which covers the common case
+// but misses a CU that declares neither.
+type cuRange struct {
+	lowpc, highpc uint64
+	cu            dwarf.Offset
+}
+
+type cuRangeSorter []cuRange
+
+func (s cuRangeSorter) Len() int           { return len(s) }
+func (s cuRangeSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s cuRangeSorter) Less(i, j int) bool { return s[i].lowpc < s[j].lowpc }
+
+// buildCUIndex returns a PC-range index of dwarff's compile units,
+// without descending into any of their children.
+func buildCUIndex(dwarff *dwarf.Data) []cuRange {
+	r := dwarff.Reader()
+	var out []cuRange
+	for {
+		ent, err := r.Next()
+		if ent == nil || err != nil {
+			break
+		}
+		if ent.Tag != dwarf.TagCompileUnit {
+			if ent.Children {
+				r.SkipChildren()
+			}
+			continue
+		}
+		for _, pr := range pcRanges(dwarff, ent) {
+			out = append(out, cuRange{pr[0], pr[1], ent.Offset})
+		}
+		if ent.Children {
+			r.SkipChildren()
+		}
+	}
+	sort.Sort(cuRangeSorter(out))
+	return out
+}
+
+// cuData holds the parsed-on-demand contents of a single compile
+// unit: its functions (with their inlines) and line table.
+type cuData struct {
+	functab []funcRange
+	linetab *lineTable
+}
+
+// loadCU parses the compile unit at off: its subprograms (and their
+// inlines) and its line table. It's the lazy counterpart to the old
+// whole-file dwarfFuncTable/dwarfLineTable, run once per CU rather
+// than once per file.
+func loadCU(dwarff *dwarf.Data, off dwarf.Offset) *cuData {
+	r := dwarff.Reader()
+	r.Seek(off)
+	cu, err := r.Next()
+	if err != nil || cu == nil {
+		return &cuData{}
+	}
+
+	lr, err := dwarff.LineReader(cu)
+	if err != nil {
+		lr = nil
+	}
+	var cuFiles []*dwarf.LineFile
+	if lr != nil {
+		cuFiles = lr.Files()
+	}
+
+	functab := walkCUSubprograms(r, dwarff, cuFiles)
+	sort.Sort(funcRangeSorter(functab))
+
+	data := &cuData{functab: functab}
+	if lr != nil {
+		data.linetab = buildLineTable(lr)
+	}
+	return data
+}
+
+// walkCUSubprograms collects the funcRanges for the subprograms
+// nested (directly or via a module or namespace) in the entries
+// remaining at r's current level, mirroring the dispatch the old
+// whole-file dwarfFuncTable used to do. It consumes entries up to and
+// including the terminating null entry for the current level.
+//
+// TODO: Use .debug_pubnames or the DWARF5 .debug_names accelerator
+// table to skip this DIE walk for CUs with many functions; neither is
+// supported by the dwarf package.
+func walkCUSubprograms(r *dwarf.Reader, dwarff *dwarf.Data, cuFiles []*dwarf.LineFile) []funcRange {
+	var out []funcRange
+	for {
+		ent, err := r.Next()
+		if ent == nil || err != nil || ent.Tag == 0 {
+			break
+		}
+		switch ent.Tag {
+		case dwarf.TagSubprogram:
+			var inlines []inlineRange
+			if ent.Children {
+				inlines = collectInlines(r, dwarff, cuFiles)
+			}
+
+			name, demangled := subprogramName(ent)
+			if name == "" {
+				break
+			}
+			for _, pr := range pcRanges(dwarff, ent) {
+				out = append(out, funcRange{name, pr[0], pr[1], demangled, inlines})
+			}
+
+		case dwarf.TagModule, dwarf.TagNamespace:
+			if ent.Children {
+				out = append(out, walkCUSubprograms(r, dwarff, cuFiles)...)
+			}
+
+		default:
+			if ent.Children {
+				r.SkipChildren()
+			}
+		}
+	}
+	return out
+}
+
+// lineTable is a compact columnar encoding of a compile unit's line
+// number program: parallel arrays indexed by row, rather than a
+// []dwarf.LineEntry per row, so a cold CU evicted from the cuCache
+// doesn't retain one fully-populated LineEntry (file pointer, column,
+// is-stmt, basic-block flag, ...) per line-table row.
+type lineTable struct {
+	pcs   []uint64 // ascending
+	lines []uint32
+	files []uint32 // index into fileTab
+	ended []bool   // EndSequence
+
+	fileTab []string
+}
+
+// buildLineTable reads every row out of lr into a lineTable. lr must
+// not have had Next called on it yet.
+func buildLineTable(lr *dwarf.LineReader) *lineTable {
+	lt := &lineTable{}
+	fileIdx := make(map[string]uint32)
+	for {
+		var ent dwarf.LineEntry
+		if err := lr.Next(&ent); err != nil {
+			break
+		}
+		name := ""
+		if ent.File != nil {
+			name = ent.File.Name
+		}
+		fi, ok := fileIdx[name]
+		if !ok {
+			fi = uint32(len(lt.fileTab))
+			fileIdx[name] = fi
+			lt.fileTab = append(lt.fileTab, name)
+		}
+		lt.pcs = append(lt.pcs, ent.Address)
+		lt.lines = append(lt.lines, uint32(ent.Line))
+		lt.files = append(lt.files, fi)
+		lt.ended = append(lt.ended, ent.EndSequence)
+	}
+	return lt
+}
+
+// find returns the line entry covering ip, the same way the old
+// []dwarf.LineEntry binary search did: the last row at or before ip,
+// unless that row ends a sequence.
+func (lt *lineTable) find(ip uint64) (dwarf.LineEntry, bool) {
+	i := sort.Search(len(lt.pcs), func(i int) bool { return ip < lt.pcs[i] })
+	if i == 0 || lt.ended[i-1] {
+		return dwarf.LineEntry{}, false
+	}
+	i--
+	le := dwarf.LineEntry{Line: int(lt.lines[i])}
+	if fi := lt.files[i]; int(fi) < len(lt.fileTab) && lt.fileTab[fi] != "" {
+		le.File = &dwarf.LineFile{Name: lt.fileTab[fi]}
+	}
+	return le, true
+}
+
+// cuCache is an LRU of parsed cuData, keyed by compile unit offset,
+// modeled on delve's dwarfTreeCache: it bounds how much parsed DWARF
+// a symbolicExtra holds onto at once, re-parsing a CU from dwarff if
+// it's been evicted.
+type cuCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[dwarf.Offset]*list.Element
+}
+
+type cuCacheEntry struct {
+	off  dwarf.Offset
+	data *cuData
+}
+
+func newCUCache(capacity int) *cuCache {
+	return &cuCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[dwarf.Offset]*list.Element),
+	}
+}
+
+// get returns the cuData for off, loading it with load and caching
+// the result if it isn't already cached.
+func (c *cuCache) get(off dwarf.Offset, load func() *cuData) *cuData {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[off]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*cuCacheEntry).data
+	}
+
+	data := load()
+	el := c.ll.PushFront(&cuCacheEntry{off, data})
+	c.items[off] = el
+
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cuCacheEntry).off)
+	}
+
+	return data
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import "testing"
+
+// countingLoader returns a load func for cuCache.get that returns a
+// distinct *cuData each call and counts how many times it ran, so
+// tests can tell a cache hit from a reload.
+func countingLoader() (load func() *cuData, calls *int) {
+	n := 0
+	return func() *cuData {
+		n++
+		return &cuData{}
+	}, &n
+}
+
+func TestCUCacheReusesCachedEntry(t *testing.T) {
+	c := newCUCache(2)
+	load, calls := countingLoader()
+
+	first := c.get(1, load)
+	second := c.get(1, load)
+
+	if first != second {
+		t.Errorf("get(1) returned a different *cuData on a cache hit")
+	}
+	if *calls != 1 {
+		t.Errorf("load called %d times, want 1", *calls)
+	}
+}
+
+func TestCUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newCUCache(2)
+	load1, calls1 := countingLoader()
+	load2, calls2 := countingLoader()
+	load3, _ := countingLoader()
+
+	d1 := c.get(1, load1)
+	c.get(2, load2)
+	c.get(1, load1) // touch 1, so 2 becomes the least recently used
+	c.get(3, load3) // over capacity: evicts 2, not 1
+
+	if d1Again := c.get(1, load1); d1Again != d1 {
+		t.Errorf("get(1) reloaded an entry that should still be cached")
+	}
+	if *calls1 != 1 {
+		t.Errorf("load for offset 1 called %d times, want 1 (should not have been evicted)", *calls1)
+	}
+
+	c.get(2, load2)
+	if *calls2 != 2 {
+		t.Errorf("load for offset 2 called %d times, want 2 (should have been evicted and reloaded)", *calls2)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// objFile abstracts over the various object file formats that
+// Symbolize needs to read symbol tables and DWARF debug info from.
+// perf traces are routinely recorded against ELF binaries on Linux,
+// but a session may also need to symbolize mmaps of Mach-O binaries
+// (macOS) or PE binaries (Windows) too. XCOFF (AIX) isn't supported:
+// the only xcoff reader in the standard library, debug/xcoff, is
+// internal to cmd/link and isn't importable from outside GOROOT.
+type objFile interface {
+	// funcTable returns the file's symbol table as function
+	// ranges. isReloc reports whether the returned lowpc/highpc
+	// values are file offsets that still need translating to
+	// virtual addresses (as for position-independent objects),
+	// rather than virtual addresses already.
+	funcTable() (functab []funcRange, isReloc bool)
+
+	// dwarf returns the file's DWARF debug info, if any, along
+	// with whether the file is position independent (so findFrames
+	// knows to translate IPs before consulting it).
+	dwarf() (data *dwarf.Data, isReloc bool, err error)
+
+	Close() error
+}
+
+// openObjFile opens filename and returns an objFile wrapping
+// whichever object file format it turns out to be. It tries each
+// supported format in turn, the same way cmd/internal/objfile does,
+// since none of the debug/* packages expose a format-sniffing
+// function of their own.
+func openObjFile(filename string) (objFile, error) {
+	if f, err := elf.Open(filename); err == nil {
+		return &elfObjFile{f}, nil
+	}
+	if f, err := macho.Open(filename); err == nil {
+		return &machoObjFile{f}, nil
+	}
+	if f, err := pe.Open(filename); err == nil {
+		return &peObjFile{f}, nil
+	}
+	return nil, fmt.Errorf("unrecognized object file format: %s", filename)
+}
+
+type elfObjFile struct {
+	f *elf.File
+}
+
+func (o *elfObjFile) Close() error { return o.f.Close() }
+
+func (o *elfObjFile) funcTable() ([]funcRange, bool) {
+	out, isReloc := elfFuncTable(o.f)
+	return out, isReloc
+}
+
+func (o *elfObjFile) dwarf() (*dwarf.Data, bool, error) {
+	if o.f.Section(".debug_info") == nil && o.f.Section(".zdebug_info") == nil {
+		return nil, false, nil
+	}
+	data, err := o.f.DWARF()
+	if err != nil {
+		return nil, false, err
+	}
+	return data, o.f.Type == elf.ET_DYN, nil
+}
+
+type machoObjFile struct {
+	f *macho.File
+}
+
+func (o *machoObjFile) Close() error { return o.f.Close() }
+
+// isReloc for Mach-O mirrors the ELF ET_EXEC/ET_DYN split: anything
+// that isn't a plain executable (a dylib, bundle, etc.) is loaded at
+// a runtime slide and needs its addresses translated the same way.
+func (o *machoObjFile) isPIE() bool {
+	return o.f.Type != macho.TypeExec
+}
+
+func (o *machoObjFile) funcTable() ([]funcRange, bool) {
+	if o.f.Symtab == nil {
+		return nil, false
+	}
+	isReloc := o.isPIE()
+	out := make([]funcRange, 0, len(o.f.Symtab.Syms))
+	for _, sym := range o.f.Symtab.Syms {
+		// N_STAB entries (stabMask, 0xe0) are debugger symbols,
+		// not functions — that includes N_BNSYM/N_ENSYM, which
+		// bracket every function in an unstripped executable and
+		// otherwise pass the N_SECT check below with the same
+		// address as the real symbol. N_SECT (0xe) is a defined
+		// symbol in some section.
+		const stabMask = 0xe0
+		if sym.Type&stabMask != 0 || sym.Type&0x0e != 0x0e || sym.Sect == 0 {
+			continue
+		}
+		addr := sym.Value
+		if isReloc {
+			// Translate the address to a file offset via its
+			// section (n_sect is 1-based), as for ELF and PE.
+			if int(sym.Sect) > len(o.f.Sections) {
+				continue
+			}
+			sec := o.f.Sections[sym.Sect-1]
+			addr = addr - sec.Addr + uint64(sec.Offset)
+		}
+		out = append(out, funcRange{sym.Name, addr, addr, false, nil})
+	}
+	sort.Sort(funcRangeSorter(out))
+	setFuncHighPCs(out)
+	return out, isReloc
+}
+
+func (o *machoObjFile) dwarf() (*dwarf.Data, bool, error) {
+	if o.f.Section("__debug_info") == nil {
+		return nil, false, nil
+	}
+	data, err := o.f.DWARF()
+	if err != nil {
+		return nil, false, err
+	}
+	return data, o.isPIE(), nil
+}
+
+type peObjFile struct {
+	f *pe.File
+}
+
+func (o *peObjFile) Close() error { return o.f.Close() }
+
+// isReloc is true for DLLs: like an ELF shared object, a DLL's
+// symbol values are relative to a base that varies at load time.
+func (o *peObjFile) isPIE() bool {
+	const imageFileDLL = 0x2000
+	return o.f.Characteristics&imageFileDLL != 0
+}
+
+func (o *peObjFile) funcTable() ([]funcRange, bool) {
+	// The high 4 bits of a COFF symbol's Type field give its
+	// derived type; IMAGE_SYM_DTYPE_FUNCTION (2) marks a function,
+	// as opposed to data symbols that also live in real sections.
+	const imageSymDTypeFunction = 2
+	isReloc := o.isPIE()
+	out := make([]funcRange, 0, len(o.f.Symbols))
+	for _, sym := range o.f.Symbols {
+		// Function symbols live in a real section; section
+		// number 0 means undefined, negative numbers are
+		// special (absolute, debug).
+		if sym.SectionNumber <= 0 || int(sym.SectionNumber) > len(o.f.Sections) {
+			continue
+		}
+		if sym.Type>>4 != imageSymDTypeFunction {
+			continue
+		}
+		sec := o.f.Sections[sym.SectionNumber-1]
+		addr := uint64(sec.VirtualAddress) + uint64(sym.Value)
+		if isReloc {
+			addr = uint64(sec.Offset) + uint64(sym.Value)
+		}
+		out = append(out, funcRange{sym.Name, addr, addr, false, nil})
+	}
+	sort.Sort(funcRangeSorter(out))
+	setFuncHighPCs(out)
+	return out, isReloc
+}
+
+func (o *peObjFile) dwarf() (*dwarf.Data, bool, error) {
+	if o.f.Section(".debug_info") == nil {
+		return nil, false, nil
+	}
+	data, err := o.f.DWARF()
+	if err != nil {
+		return nil, false, err
+	}
+	return data, o.isPIE(), nil
+}
+
+func elfFuncTable(elff *elf.File) (out []funcRange, isReloc bool) {
+	switch elff.Type {
+	case elf.ET_EXEC:
+		// Symbol values are virtual addresses.
+		isReloc = false
+	case elf.ET_DYN:
+		// Symbol values are section-relative offsets. This
+		// will resolve them to file offsets.
+		isReloc = true
+	default:
+		return nil, false
+	}
+
+	out = make([]funcRange, 0)
+	syms, err := elff.Symbols()
+	if err != nil {
+		if err != elf.ErrNoSymbols {
+			log.Fatalf("%s", err)
+		}
+		return nil, false
+	}
+	for _, sym := range syms {
+		if elf.SymType(sym.Info&0xF) != elf.STT_FUNC || sym.Section == elf.SHN_UNDEF {
+			continue
+		}
+		lowpc := sym.Value
+		if isReloc {
+			// lowpc is a section-relative offset.
+			// Translate it to a file offset.
+			if int(sym.Section) >= len(elff.Sections) {
+				continue
+			}
+			sec := elff.Sections[sym.Section]
+			lowpc = lowpc - sec.Addr + sec.Offset
+		}
+		out = append(out, funcRange{sym.Name, lowpc, lowpc + sym.Size, false, nil})
+	}
+
+	sort.Sort(funcRangeSorter(out))
+	setFuncHighPCs(out)
+
+	return
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"debug/macho"
+	"debug/pe"
+	"testing"
+)
+
+func funcNames(functab []funcRange) []string {
+	var out []string
+	for _, f := range functab {
+		out = append(out, f.name)
+	}
+	return out
+}
+
+func TestMachoFuncTableExcludesStabs(t *testing.T) {
+	const nSect = 0x0e
+	const nBNSYM = 0x2e
+	const nENSYM = 0x4e
+
+	o := &machoObjFile{f: &macho.File{
+		FileHeader: macho.FileHeader{Type: macho.TypeExec},
+		Symtab: &macho.Symtab{Syms: []macho.Symbol{
+			{Name: "", Type: nBNSYM, Sect: 1, Value: 0x1000},
+			{Name: "real.Func", Type: nSect, Sect: 1, Value: 0x1000},
+			{Name: "", Type: nENSYM, Sect: 1, Value: 0x1000},
+		}},
+	}}
+
+	functab, isReloc := o.funcTable()
+	if isReloc {
+		t.Errorf("isReloc = true for macho.TypeExec, want false")
+	}
+	if got := funcNames(functab); len(got) != 1 || got[0] != "real.Func" {
+		t.Errorf("funcTable() = %v, want only [real.Func]", got)
+	}
+}
+
+func TestPEFuncTableExcludesDataSymbols(t *testing.T) {
+	const imageSymDTypeFunction = 2 << 4
+	const imageSymDTypeNull = 0 << 4
+
+	o := &peObjFile{f: &pe.File{
+		Sections: []*pe.Section{{SectionHeader: pe.SectionHeader{VirtualAddress: 0x1000}}},
+		Symbols: []*pe.Symbol{
+			{Name: "data.Var", SectionNumber: 1, Type: imageSymDTypeNull, Value: 0x10},
+			{Name: "real.Func", SectionNumber: 1, Type: imageSymDTypeFunction, Value: 0x20},
+		},
+	}}
+
+	functab, _ := o.funcTable()
+	if got := funcNames(functab); len(got) != 1 || got[0] != "real.Func" {
+		t.Errorf("funcTable() = %v, want only [real.Func]", got)
+	}
+}
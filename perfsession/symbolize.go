@@ -7,9 +7,7 @@ package perfsession
 import (
 	"bufio"
 	"debug/dwarf"
-	"debug/elf"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/user"
@@ -21,11 +19,21 @@ import (
 	"github.com/ianlancetaylor/demangle"
 )
 
-type Symbolic struct {
+// Frame describes one logical frame at an IP: either the physical
+// function containing it, or one of the functions inlined into that
+// function at that IP.
+type Frame struct {
 	FuncName string
 	Line     dwarf.LineEntry
 }
 
+type Symbolic struct {
+	// Frames holds the frame stack for an IP, innermost (the
+	// most deeply inlined call) first and the physical function
+	// last.
+	Frames []Frame
+}
+
 // TODO: Take a PID and look up the mmap.
 
 func Symbolize(session *Session, mmap *Mmap, ip uint64, out *Symbolic) bool {
@@ -33,17 +41,7 @@ func Symbolize(session *Session, mmap *Mmap, ip uint64, out *Symbolic) bool {
 	if s == nil {
 		return false
 	}
-	f, l := s.findIP(mmap, ip)
-	if f == nil {
-		out.FuncName = ""
-	} else {
-		out.FuncName = f.name
-	}
-	if l == nil {
-		out.Line = dwarf.LineEntry{}
-	} else {
-		out.Line = *l
-	}
+	out.Frames = s.findFrames(mmap, ip)
 	return true
 }
 
@@ -100,7 +98,7 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 			if isKallsyms {
 				extra, err = newKallsyms(nfilename)
 			} else {
-				extra, err = newSymbolicExtra(nfilename)
+				extra, err = newSymbolicExtra(session, nfilename)
 			}
 			if err == nil {
 				break
@@ -110,7 +108,7 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 
 	// Try original path.
 	if extra == nil {
-		extra, err = newSymbolicExtra(filename)
+		extra, err = newSymbolicExtra(session, filename)
 		if err != nil {
 			log.Println(err)
 		}
@@ -120,40 +118,47 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 	return extra
 }
 
-func newSymbolicExtra(filename string) (*symbolicExtra, error) {
-	// Load ELF
-	elff, err := elf.Open(filename)
+func newSymbolicExtra(session *Session, filename string) (*symbolicExtra, error) {
+	obj, err := openObjFile(filename)
 	if err != nil {
-		return nil, fmt.Errorf("error loading ELF file %s: %s", filename, err)
+		return nil, fmt.Errorf("error loading object file %s: %s", filename, err)
 	}
-	defer elff.Close()
+	defer obj.Close()
 
 	extra := &symbolicExtra{}
 
-	// Load DWARF
-	//
-	// TODO: Support build IDs and debug links
-	//
-	// TODO: Support DWARF for relocatable objects
-	if elff.Type == elf.ET_EXEC && (elff.Section(".debug_info") != nil || elff.Section(".zdebug_info") != nil) {
-		dwarff, err := elff.DWARF()
-		if err != nil {
-			return nil, fmt.Errorf("error loading DWARF from %s: %s", filename, err)
+	// Load DWARF, either embedded in the object file or, failing
+	// that, from a separate debug-info file found via the GNU
+	// debuglink/build-id conventions.
+	dwarff, isReloc, err := obj.dwarf()
+	if err != nil {
+		return nil, fmt.Errorf("error loading DWARF from %s: %s", filename, err)
+	}
+	if dwarff == nil {
+		if finder, ok := obj.(debugInfoFinder); ok {
+			dwarff, isReloc, err = finder.findDebugInfo(debugDirs(session), filename)
+			if err != nil {
+				return nil, fmt.Errorf("error loading DWARF for %s: %s", filename, err)
+			}
 		}
-
-		extra.functab = dwarfFuncTable(dwarff)
-		extra.linetab = dwarfLineTable(dwarff)
-
-		return &symbolicExtra{
-			dwarfFuncTable(dwarff),
-			dwarfLineTable(dwarff),
-			false,
-		}, nil
+	}
+	if dwarff != nil {
+		// Rather than walking every DIE up front, keep only a
+		// PC-range index of compile units resident; each CU's
+		// subprograms and line table are parsed on first lookup
+		// and cached in cuCache, so the memory cost tracks the
+		// working set actually being symbolized rather than the
+		// whole binary's debug info.
+		extra.dwarff = dwarff
+		extra.cus = buildCUIndex(dwarff)
+		extra.cuCache = newCUCache(cuIndexCapacity)
+		extra.isReloc = isReloc
+		return extra, nil
 	}
 
 	if extra.functab == nil {
-		// Make do with the ELF symbols.
-		extra.functab, extra.isReloc = elfFuncTable(filename, elff)
+		// Make do with the object file's native symbol table.
+		extra.functab, extra.isReloc = obj.funcTable()
 	}
 
 	return extra, nil
@@ -182,7 +187,7 @@ func newKallsyms(filename string) (*symbolicExtra, error) {
 			continue
 		}
 		addr, _ := strconv.ParseUint(subs[1], 16, 64)
-		functab = append(functab, funcRange{name, addr, addr, true})
+		functab = append(functab, funcRange{name, addr, addr, true, nil})
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
@@ -191,155 +196,299 @@ func newKallsyms(filename string) (*symbolicExtra, error) {
 	sort.Sort(funcRangeSorter(functab))
 	setFuncHighPCs(functab)
 
-	return &symbolicExtra{functab, nil, false}, nil
+	return &symbolicExtra{functab: functab}, nil
 }
 
 type symbolicExtra struct {
+	// functab and isReloc hold the object file's native symbol
+	// table, used when there's no DWARF to consult.
 	functab []funcRange
-	linetab []dwarf.LineEntry
 
-	// isReloc indicates that lowpc/highpc in functab are ELF file
-	// offsets rather than virtual addresses.
+	// isReloc indicates that lowpc/highpc in functab (and the
+	// cus index below) are file offsets rather than virtual
+	// addresses, as for a position-independent object.
 	isReloc bool
+
+	// dwarff, cus and cuCache back the lazy DWARF path: cus
+	// indexes which compile unit covers a PC, and cuCache holds
+	// each CU's parsed functab/line table, populated on demand by
+	// findFramesDWARF. Nil when the object has no DWARF.
+	dwarff  *dwarf.Data
+	cus     []cuRange
+	cuCache *cuCache
 }
 
-func (s *symbolicExtra) findIP(mmap *Mmap, ip uint64) (f *funcRange, l *dwarf.LineEntry) {
-	if s.functab != nil {
-		if s.isReloc {
-			// functab is indexed by file offset.
-			ip = ip - mmap.Addr + mmap.FileOffset
-		}
-		i := sort.Search(len(s.functab), func(i int) bool {
-			return ip < s.functab[i].highpc
-		})
-		if i < len(s.functab) && s.functab[i].lowpc <= ip && ip < s.functab[i].highpc {
-			f = &s.functab[i]
-			if !f.demangled {
-				f.name = demangle.Filter(f.name)
-				f.demangled = true
-			}
+// findFrames returns the frame stack for ip, innermost first, ending
+// with the physical function that contains ip. It returns nil if ip
+// doesn't resolve to a known function.
+//
+// TODO: When the object has no DWARF (or its DWARF lacks
+// DW_TAG_inlined_subroutine records, e.g. a binary built with
+// -gcflags=-l), fall back to Go's own inlining metadata: the
+// runtime.InlTree rooted at each function's funcdata, as cmd/pprof's
+// proftab does. For now a function without DWARF inline records
+// reports only its physical frame.
+func (s *symbolicExtra) findFrames(mmap *Mmap, ip uint64) []Frame {
+	if s.isReloc {
+		// functab/cus are indexed by file offset rather than
+		// virtual address, as for a position-independent object
+		// (e.g. ELF ET_DYN).
+		ip = ip - mmap.Addr + mmap.FileOffset
+	}
+
+	if s.dwarff != nil {
+		return s.findFramesDWARF(ip)
+	}
+
+	f := findFuncRange(s.functab, ip)
+	if f == nil {
+		return nil
+	}
+	if !f.demangled {
+		f.name = demangle.Filter(f.name)
+		f.demangled = true
+	}
+	return assembleFrames(f, ip, nil)
+}
+
+// findFramesDWARF is findFrames' DWARF path: it looks up which
+// compile unit covers ip, demand-loads that CU's functab and line
+// table (caching the result), and then proceeds the same way the
+// plain symbol-table path does.
+func (s *symbolicExtra) findFramesDWARF(ip uint64) []Frame {
+	ci := sort.Search(len(s.cus), func(i int) bool { return ip < s.cus[i].highpc })
+	if ci >= len(s.cus) || s.cus[ci].lowpc > ip || ip >= s.cus[ci].highpc {
+		return nil
+	}
+	cu := s.cus[ci]
+
+	data := s.cuCache.get(cu.cu, func() *cuData { return loadCU(s.dwarff, cu.cu) })
+
+	f := findFuncRange(data.functab, ip)
+	if f == nil {
+		return nil
+	}
+	if !f.demangled {
+		f.name = demangle.Filter(f.name)
+		f.demangled = true
+	}
+
+	var line *dwarf.LineEntry
+	if data.linetab != nil {
+		if le, ok := data.linetab.find(ip); ok {
+			line = &le
 		}
 	}
+	return assembleFrames(f, ip, line)
+}
 
-	if s.linetab != nil {
-		i := sort.Search(len(s.linetab), func(i int) bool {
-			return ip < s.linetab[i].Address
-		})
-		if i != 0 && !s.linetab[i-1].EndSequence {
-			l = &s.linetab[i-1]
+// findFuncRange returns the funcRange in functab (sorted by lowpc)
+// that covers ip, or nil if none does.
+func findFuncRange(functab []funcRange, ip uint64) *funcRange {
+	i := sort.Search(len(functab), func(i int) bool { return ip < functab[i].highpc })
+	if i >= len(functab) || functab[i].lowpc > ip || ip >= functab[i].highpc {
+		return nil
+	}
+	return &functab[i]
+}
+
+// assembleFrames builds the frame stack for ip within f: the chain of
+// inlined calls containing ip, innermost first, followed by f itself.
+// line, if non-nil, is the line-table entry for ip and is attached to
+// the innermost frame; each inlined frame's line comes from its own
+// call site instead.
+func assembleFrames(f *funcRange, ip uint64, line *dwarf.LineEntry) []Frame {
+	chain := findInline(ip, f.inlines)
+	frames := make([]Frame, 0, len(chain)+1)
+	for _, inl := range chain {
+		frames = append(frames, Frame{FuncName: inl.name})
+	}
+	frames = append(frames, Frame{FuncName: f.name})
+
+	if line != nil {
+		frames[0].Line = *line
+	}
+	for i := 1; i < len(frames); i++ {
+		// The call site recorded on chain[i-1] (the next frame
+		// in) is where that inlined call was made from, i.e.
+		// frames[i]'s line.
+		cs := chain[i-1]
+		if cs.callFile != "" {
+			frames[i].Line.File = &dwarf.LineFile{Name: cs.callFile}
 		}
+		frames[i].Line.Line = int(cs.callLine)
 	}
 
-	return
+	return frames
 }
 
 type funcRange struct {
 	name          string
 	lowpc, highpc uint64
 	demangled     bool
+
+	// inlines holds the functions inlined directly into this one,
+	// as a tree: each inlineRange's children were in turn inlined
+	// into it. A PC range in a child is always contained within
+	// its parent's.
+	inlines []inlineRange
 }
 
-func dwarfFuncTable(dwarff *dwarf.Data) []funcRange {
-	// Walk DWARF for functions
-	// TODO: Use .debug_pubnames (not supported by dwarf package)
-	r := dwarff.Reader()
-	out := make([]funcRange, 0)
-	for {
-		ent, err := r.Next()
-		if ent == nil || err != nil {
-			break
-		}
-		// TODO: We should process TagInlinedSubroutine, but
-		// apparently gc doesn't produce these.
-		//
-		// TODO: Support DW_AT_ranges.
-	tag:
-		switch ent.Tag {
-		case dwarf.TagSubprogram:
-			r.SkipChildren()
-			const AttrLinkageName dwarf.Attr = 0x6e
-			name, ok := ent.Val(AttrLinkageName).(string)
-			demangled := true
-			if !ok {
-				name, ok = ent.Val(dwarf.AttrName).(string)
-				demangled = false
-				if !ok {
-					break
-				}
-			}
-			lowpc, ok := ent.Val(dwarf.AttrLowpc).(uint64)
-			if !ok {
-				break
-			}
-			var highpc uint64
-			switch highpcx := ent.Val(dwarf.AttrHighpc).(type) {
-			case uint64:
-				highpc = highpcx
-			case int64:
-				highpc = lowpc + uint64(highpcx)
-			default:
-				break tag
-			}
-			out = append(out, funcRange{name, lowpc, highpc, demangled})
+// inlineRange describes one DW_TAG_inlined_subroutine: the function
+// that was inlined, the PC range its code occupies, and the call
+// site (in its enclosing scope) it was inlined from.
+type inlineRange struct {
+	name          string
+	lowpc, highpc uint64
+	callFile      string
+	callLine      int64
 
-		case dwarf.TagCompileUnit, dwarf.TagModule, dwarf.TagNamespace:
-			break
+	children []inlineRange
+}
 
-		default:
-			r.SkipChildren()
+// findInline returns the chain of inlineRanges containing ip, from
+// the innermost (most deeply nested) match to the outermost. It
+// returns nil if ip isn't covered by any of ranges.
+func findInline(ip uint64, ranges []inlineRange) []inlineRange {
+	for i := range ranges {
+		ir := &ranges[i]
+		if ir.lowpc <= ip && ip < ir.highpc {
+			return append(findInline(ip, ir.children), *ir)
 		}
 	}
+	return nil
+}
 
-	sort.Sort(funcRangeSorter(out))
+const attrLinkageName dwarf.Attr = 0x6e
 
-	if len(out) == 0 {
-		return nil
+// subprogramName returns ent's mangled linkage name if it has one,
+// falling back to its plain DW_AT_name, and reports whether the
+// returned name is already demangled (i.e. is the plain name).
+func subprogramName(ent *dwarf.Entry) (name string, demangled bool) {
+	if name, ok := ent.Val(attrLinkageName).(string); ok {
+		return name, false
 	}
-	return out
+	name, _ = ent.Val(dwarf.AttrName).(string)
+	return name, true
 }
 
-func elfFuncTable(filename string, elff *elf.File) (out []funcRange, isReloc bool) {
-	switch elff.Type {
-	case elf.ET_EXEC:
-		// Symbol values are virtual addresses.
-		isReloc = false
-	case elf.ET_DYN:
-		// Symbol values are section-relative offsets. This
-		// will resolve them to file offsets.
-		isReloc = true
+// lowHighPC returns ent's PC range from its DW_AT_low_pc/DW_AT_high_pc
+// attributes.
+func lowHighPC(ent *dwarf.Entry) (lowpc, highpc uint64, ok bool) {
+	lowpc, ok = ent.Val(dwarf.AttrLowpc).(uint64)
+	if !ok {
+		return 0, 0, false
+	}
+	switch highpcx := ent.Val(dwarf.AttrHighpc).(type) {
+	case uint64:
+		highpc = highpcx
+	case int64:
+		highpc = lowpc + uint64(highpcx)
 	default:
-		return nil, false
+		return 0, 0, false
 	}
+	return lowpc, highpc, true
+}
 
-	out = make([]funcRange, 0)
-	syms, err := elff.Symbols()
+// pcRanges returns the PC ranges covered by ent: either its single
+// DW_AT_low_pc/high_pc range, or, for entries built with
+// -ffunction-sections, LTO, or similar that are split across
+// multiple discontiguous ranges, its DW_AT_ranges. dwarf.Data.Ranges
+// already resolves both the legacy .debug_ranges form and DWARF5
+// .debug_rnglists (via DW_AT_rnglists_base), and low_pc/addr_base
+// attributes encoded as DW_FORM_addrx are resolved transparently by
+// the dwarf package's Entry.Val, so no extra work is needed for
+// split-DWARF .debug_addr indirection here.
+func pcRanges(dwarff *dwarf.Data, ent *dwarf.Entry) [][2]uint64 {
+	if lowpc, highpc, ok := lowHighPC(ent); ok {
+		return [][2]uint64{{lowpc, highpc}}
+	}
+	ranges, err := dwarff.Ranges(ent)
 	if err != nil {
-		if err != elf.ErrNoSymbols {
-			log.Fatalf("%s: %s", filename, err)
-		}
-		return nil, false
+		return nil
 	}
-	for _, sym := range syms {
-		if elf.SymType(sym.Info&0xF) != elf.STT_FUNC || sym.Section == elf.SHN_UNDEF {
-			continue
+	return ranges
+}
+
+// collectInlines walks the children of a DW_TAG_subprogram (or, via
+// recursion, a DW_TAG_lexical_block inside one) and returns the
+// DW_TAG_inlined_subroutine entries found, as a tree mirroring their
+// DWARF nesting. It consumes entries from r up to and including the
+// terminating null entry for the current level.
+func collectInlines(r *dwarf.Reader, dwarff *dwarf.Data, cuFiles []*dwarf.LineFile) []inlineRange {
+	var out []inlineRange
+	for {
+		ent, err := r.Next()
+		if ent == nil || err != nil || ent.Tag == 0 {
+			break
 		}
-		lowpc := sym.Value
-		if isReloc {
-			// lowpc is a section-relative offset.
-			// Translate it to a file offset.
-			if int(sym.Section) >= len(elff.Sections) {
-				continue
+		switch ent.Tag {
+		case dwarf.TagInlinedSubroutine:
+			var children []inlineRange
+			if ent.Children {
+				children = collectInlines(r, dwarff, cuFiles)
+			}
+			if base, ok := inlineRangeFromEntry(ent, dwarff, cuFiles); ok {
+				// As with walkCUSubprograms' subprograms, an
+				// inlined call split across multiple ranges
+				// shares the same children and call site.
+				for _, pr := range pcRanges(dwarff, ent) {
+					ir := base
+					ir.lowpc, ir.highpc = pr[0], pr[1]
+					ir.children = children
+					out = append(out, ir)
+				}
+			}
+
+		case dwarf.TagLexDwarfBlock:
+			if ent.Children {
+				out = append(out, collectInlines(r, dwarff, cuFiles)...)
+			}
+
+		default:
+			if ent.Children {
+				r.SkipChildren()
 			}
-			sec := elff.Sections[sym.Section]
-			lowpc = lowpc - sec.Addr + sec.Offset
 		}
-		out = append(out, funcRange{sym.Name, lowpc, lowpc + sym.Size, false})
+	}
+	return out
+}
+
+// inlineRangeFromEntry builds an inlineRange template from a
+// DW_TAG_inlined_subroutine entry, resolving its name via
+// DW_AT_abstract_origin and its call site's file name via cuFiles.
+// The returned inlineRange's lowpc/highpc are unset; the caller fills
+// them in per pcRanges(dwarff, ent), since an inlined call can itself
+// be split across multiple discontiguous ranges.
+func inlineRangeFromEntry(ent *dwarf.Entry, dwarff *dwarf.Data, cuFiles []*dwarf.LineFile) (inlineRange, bool) {
+	var ir inlineRange
+
+	if origin, ok := ent.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset); ok {
+		ir.name = abstractOriginName(dwarff, origin)
+	}
+	if ir.name == "" {
+		return ir, false
 	}
 
-	sort.Sort(funcRangeSorter(out))
-	setFuncHighPCs(out)
+	if cf, ok := ent.Val(dwarf.AttrCallFile).(int64); ok && cf >= 0 && int(cf) < len(cuFiles) && cuFiles[cf] != nil {
+		ir.callFile = cuFiles[cf].Name
+	}
+	ir.callLine, _ = ent.Val(dwarf.AttrCallLine).(int64)
 
-	return
+	return ir, true
+}
+
+// abstractOriginName resolves a DW_AT_abstract_origin reference to
+// the name of the subprogram it points to.
+func abstractOriginName(dwarff *dwarf.Data, origin dwarf.Offset) string {
+	r := dwarff.Reader()
+	r.Seek(origin)
+	ent, err := r.Next()
+	if err != nil || ent == nil {
+		return ""
+	}
+	name, _ := subprogramName(ent)
+	return name
 }
 
 type funcRangeSorter []funcRange
@@ -370,42 +519,3 @@ func setFuncHighPCs(functab []funcRange) {
 		}
 	}
 }
-
-func dwarfLineTable(dwarff *dwarf.Data) []dwarf.LineEntry {
-	out := make([]dwarf.LineEntry, 0)
-
-	// Iterate over compilation units
-	dr := dwarff.Reader()
-	for {
-		ent, err := dr.Next()
-		if ent == nil || err != nil {
-			break
-		}
-
-		if ent.Tag != dwarf.TagCompileUnit {
-			dr.SkipChildren()
-			continue
-		}
-
-		// Decode CU's line table
-		lr, err := dwarff.LineReader(ent)
-		if err != nil {
-			log.Fatal(err)
-		} else if lr == nil {
-			continue
-		}
-
-		for {
-			var lent dwarf.LineEntry
-			err := lr.Next(&lent)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				log.Fatal(err)
-			}
-			out = append(out, lent)
-		}
-	}
-	return out
-}
@@ -0,0 +1,80 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindInline(t *testing.T) {
+	// outer contains mid, which in turn contains inner, each
+	// narrowing the PC range: [0,100) -> [10,50) -> [20,30).
+	inner := inlineRange{name: "inner", lowpc: 20, highpc: 30}
+	mid := inlineRange{name: "mid", lowpc: 10, highpc: 50, children: []inlineRange{inner}}
+	ranges := []inlineRange{mid}
+
+	tests := []struct {
+		ip   uint64
+		want []string
+	}{
+		{25, []string{"inner", "mid"}},
+		{15, []string{"mid"}},
+		{5, nil},
+		{60, nil},
+	}
+	for _, tt := range tests {
+		chain := findInline(tt.ip, ranges)
+		var got []string
+		for _, ir := range chain {
+			got = append(got, ir.name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("findInline(%d) chain = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAssembleFrames(t *testing.T) {
+	inner := inlineRange{name: "inner", lowpc: 20, highpc: 30, callFile: "mid.go", callLine: 7}
+	mid := inlineRange{name: "mid", lowpc: 10, highpc: 50, callFile: "outer.go", callLine: 3, children: []inlineRange{inner}}
+	f := &funcRange{name: "outer", lowpc: 0, highpc: 100, inlines: []inlineRange{mid}}
+
+	frames := assembleFrames(f, 25, nil)
+
+	wantNames := []string{"inner", "mid", "outer"}
+	if len(frames) != len(wantNames) {
+		t.Fatalf("assembleFrames() = %d frames, want %d", len(frames), len(wantNames))
+	}
+	for i, name := range wantNames {
+		if frames[i].FuncName != name {
+			t.Errorf("frames[%d].FuncName = %q, want %q", i, frames[i].FuncName, name)
+		}
+	}
+
+	// frames[1] ("mid") is where "inner" was called from.
+	if got, want := frames[1].Line.File.Name, "mid.go"; got != want {
+		t.Errorf("frames[1].Line.File.Name = %q, want %q", got, want)
+	}
+	if got, want := frames[1].Line.Line, 7; got != want {
+		t.Errorf("frames[1].Line.Line = %d, want %d", got, want)
+	}
+
+	// frames[2] ("outer") is where "mid" was called from.
+	if got, want := frames[2].Line.File.Name, "outer.go"; got != want {
+		t.Errorf("frames[2].Line.File.Name = %q, want %q", got, want)
+	}
+	if got, want := frames[2].Line.Line, 3; got != want {
+		t.Errorf("frames[2].Line.Line = %d, want %d", got, want)
+	}
+}
+
+func TestAssembleFramesNoInlines(t *testing.T) {
+	f := &funcRange{name: "outer", lowpc: 0, highpc: 100}
+	frames := assembleFrames(f, 25, nil)
+	if len(frames) != 1 || frames[0].FuncName != "outer" {
+		t.Errorf("assembleFrames() = %v, want single outer frame", frames)
+	}
+}